@@ -0,0 +1,245 @@
+package interstate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// FSNotifier is a Notifier that watches the store directory for changes, so
+// that subscribers are notified of writes made by any process sharing the
+// directory.
+// Because every change is observed through the filesystem, including those
+// made by this process, Put and Delete do nothing and handlers are called
+// asynchronously.
+type FSNotifier struct {
+	watcher   *fsnotify.Watcher
+	done      chan struct{}
+	errors    chan error
+	closeOnce sync.Once
+	closeErr  error
+
+	mu          sync.Mutex
+	subscribers map[string][]*fsSubscriber
+}
+
+type fsSubscriber struct {
+	handler SubscribeHandler
+}
+
+// NewFSNotifier starts watching dir, which should be the directory of the
+// store. The directory will be created if it does not exist. Call Close to
+// stop watching.
+func NewFSNotifier(dir string) (*FSNotifier, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create store directory: %w", err)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create watcher: %w", err)
+	}
+
+	n := &FSNotifier{
+		watcher:     watcher,
+		done:        make(chan struct{}),
+		errors:      make(chan error, 16),
+		subscribers: make(map[string][]*fsSubscriber),
+	}
+
+	if err := n.watchTree(dir); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	go n.run()
+
+	return n, nil
+}
+
+// Put does nothing. Subscribers are notified when the write is observed on
+// the filesystem.
+func (n *FSNotifier) Put(key string, data []byte) {}
+
+// Delete does nothing. Subscribers are notified when the delete is observed on
+// the filesystem.
+func (n *FSNotifier) Delete(key string) {}
+
+func (n *FSNotifier) Subscribe(key string, handler SubscribeHandler) UnsubscribeFn {
+	hash := hashKey(key)
+	sub := &fsSubscriber{handler: handler}
+
+	n.mu.Lock()
+	n.subscribers[hash] = append(n.subscribers[hash], sub)
+	n.mu.Unlock()
+
+	return func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+
+		n.subscribers[hash] = slices.DeleteFunc(n.subscribers[hash], func(v *fsSubscriber) bool {
+			return v == sub
+		})
+	}
+}
+
+// Errors returns a channel that receives errors from watching the store
+// directory. Errors are dropped if the channel is full, so it does not need to
+// be read.
+func (n *FSNotifier) Errors() <-chan error {
+	return n.errors
+}
+
+// Close stops watching the store directory. It is safe to call Close more than
+// once, including concurrently; every call returns the result of the first.
+func (n *FSNotifier) Close() error {
+	n.closeOnce.Do(func() {
+		close(n.done)
+
+		if err := n.watcher.Close(); err != nil {
+			n.closeErr = fmt.Errorf("failed to close watcher: %w", err)
+		}
+	})
+
+	return n.closeErr
+}
+
+// watchTree watches dir and any subdirectories, which are present when the
+// store is sharded.
+func (n *FSNotifier) watchTree(dir string) error {
+	return filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.IsDir() {
+			return nil
+		}
+
+		if err := n.watcher.Add(p); err != nil {
+			return fmt.Errorf("failed to watch %q: %w", p, err)
+		}
+
+		return nil
+	})
+}
+
+func (n *FSNotifier) run() {
+	for {
+		select {
+		case <-n.done:
+			return
+		case event, ok := <-n.watcher.Events:
+			if !ok {
+				return
+			}
+
+			n.handleEvent(event)
+		case err, ok := <-n.watcher.Errors:
+			if !ok {
+				return
+			}
+
+			n.reportError(err)
+		}
+	}
+}
+
+func (n *FSNotifier) reportError(err error) {
+	select {
+	case n.errors <- err:
+	default:
+	}
+}
+
+func (n *FSNotifier) handleEvent(event fsnotify.Event) {
+	if event.Has(fsnotify.Create) {
+		if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+			n.handleNewDir(event.Name)
+			return
+		}
+	}
+
+	hash := filepath.Base(event.Name)
+	if !isKeyHash(hash) {
+		return
+	}
+
+	switch {
+	case event.Has(fsnotify.Create) || event.Has(fsnotify.Write):
+		n.notifyPut(event.Name)
+	case event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename):
+		for _, sub := range n.subscribersFor(hash) {
+			sub.handler(UpdateOperationDelete, nil)
+		}
+	}
+}
+
+// handleNewDir watches a directory created in the store, such as a new shard.
+// Keys may have been written to the directory before the watch was added, so
+// subscribers are notified of any that are already present. This can result
+// in a key written right after the directory was created being notified
+// twice.
+func (n *FSNotifier) handleNewDir(dir string) {
+	if err := n.watchTree(dir); err != nil {
+		n.reportError(err)
+		return
+	}
+
+	err := filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.IsDir() && isKeyHash(d.Name()) {
+			n.notifyPut(p)
+		}
+
+		return nil
+	})
+	if err != nil {
+		n.reportError(fmt.Errorf("failed to scan %q: %w", dir, err))
+	}
+}
+
+func (n *FSNotifier) notifyPut(name string) {
+	subscribers := n.subscribersFor(filepath.Base(name))
+	if len(subscribers) == 0 {
+		return
+	}
+
+	// The file may have already been replaced or deleted, in which case there
+	// will be another event for it.
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return
+	}
+
+	for _, sub := range subscribers {
+		sub.handler(UpdateOperationPut, data)
+	}
+}
+
+func (n *FSNotifier) subscribersFor(hash string) []*fsSubscriber {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return slices.Clone(n.subscribers[hash])
+}
+
+// isKeyHash reports whether name is the name of a data file, rather than a
+// lock, key name or temporary file.
+func isKeyHash(name string) bool {
+	if len(name) != hex.EncodedLen(sha256.Size) {
+		return false
+	}
+
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
@@ -2,7 +2,11 @@ module github.com/dstreet/interstate
 
 go 1.23
 
-require github.com/stretchr/testify v1.9.0
+require (
+	github.com/fsnotify/fsnotify v1.10.1
+	github.com/stretchr/testify v1.9.0
+	golang.org/x/sys v0.13.0
+)
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
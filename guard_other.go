@@ -0,0 +1,38 @@
+//go:build !unix && !windows
+
+package interstate
+
+import (
+	"errors"
+	"os"
+	"sync"
+)
+
+var errFileLocked = errors.New("file is locked")
+
+// File locks are not available on this platform, so guards only serialize
+// goroutines within this process.
+var (
+	guardsMu sync.Mutex
+	guards   = make(map[string]bool)
+)
+
+func tryLockFile(f *os.File) error {
+	guardsMu.Lock()
+	defer guardsMu.Unlock()
+
+	if guards[f.Name()] {
+		return errFileLocked
+	}
+
+	guards[f.Name()] = true
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	guardsMu.Lock()
+	defer guardsMu.Unlock()
+
+	delete(guards, f.Name())
+	return nil
+}
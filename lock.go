@@ -0,0 +1,267 @@
+package interstate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tryLock atomically creates the lock file, returning an owner token that
+// identifies this lock, or ErrKeyLocked if the lock already exists. If the
+// existing lock is stale, it is reclaimed while holding the lock's guard, and
+// only if it has not changed since it was found to be stale.
+func tryLock(ctx context.Context, lock string, staleTTL time.Duration) (string, error) {
+	owner, err := createLock(lock)
+	if !errors.Is(err, ErrKeyLocked) {
+		return owner, err
+	}
+
+	contents, stale, err := isStaleLock(lock, staleTTL)
+	if err != nil {
+		return "", err
+	}
+
+	if !stale {
+		return "", ErrKeyLocked
+	}
+
+	err = withLockGuard(ctx, lock, func() error {
+		current, err := os.ReadFile(lock)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to read lock: %w", err)
+		}
+
+		// Another process has reclaimed the lock since it was checked.
+		if err == nil && !bytes.Equal(current, contents) {
+			return ErrKeyLocked
+		}
+
+		if err := os.Remove(lock); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove stale lock: %w", err)
+		}
+
+		owner, err = createLock(lock)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return owner, nil
+}
+
+// releaseLock removes the lock, but only if it is still owned by owner. The
+// lock may have been reclaimed by another process if it was held for longer
+// than the stale lock TTL.
+func releaseLock(lock string, owner string) error {
+	return withLockGuard(context.Background(), lock, func() error {
+		current, err := os.ReadFile(lock)
+		if err != nil && errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to read lock: %w", err)
+		}
+
+		if string(current) != owner {
+			return nil
+		}
+
+		if err := os.Remove(lock); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove lock: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// acquireLock calls try once, or, if waiting for the lock, until it no longer
+// returns ErrKeyLocked. The context passed to try is done when the caller's
+// context is done or the wait timeout is exceeded, in which case the error is
+// the context's error or ErrLockTimeout respectively.
+func acquireLock(options *updaterOptions, try func(ctx context.Context) error) error {
+	ctx := options.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if options.waitForLock && options.waitTimeout != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, *options.waitTimeout, ErrLockTimeout)
+		defer cancel()
+	}
+
+	if !options.waitForLock {
+		return try(ctx)
+	}
+
+	return waitForLock(ctx, try, options.pollingInterval)
+}
+
+func waitForLock(ctx context.Context, try func(ctx context.Context) error, poll time.Duration) error {
+	for {
+		err := try(ctx)
+		if !errors.Is(err, ErrKeyLocked) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		case <-time.After(poll):
+		}
+	}
+}
+
+// createLock creates the lock file and records the owner: the PID, the time
+// the lock was taken, the host the process is running on and a random nonce.
+// The contents are returned as the owner token.
+func createLock(lock string) (string, error) {
+	f, err := os.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil && errors.Is(err, os.ErrExist) {
+		return "", ErrKeyLocked
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("failed to create lock file: %w", err)
+	}
+	defer f.Close()
+
+	owner := fmt.Sprintf("%d %d %s %x\n", os.Getpid(), time.Now().UnixNano(), lockHostID(), rand.Uint64())
+	if _, err := f.WriteString(owner); err != nil {
+		os.Remove(lock)
+		return "", fmt.Errorf("failed to write lock file: %w", err)
+	}
+
+	return owner, nil
+}
+
+// isStaleLock reports whether the lock is owned by a process that is no longer
+// running, or is older than staleTTL, along with the contents of the lock that
+// were checked. A staleTTL of 0 disables the age check.
+// The owner's PID is only checked if the lock was created on the same host and
+// in the same PID namespace; otherwise, such as when the directory is shared
+// between containers or over NFS, only the age check applies.
+// Locks without a readable owner fall back to the file's modification time.
+func isStaleLock(lock string, staleTTL time.Duration) ([]byte, bool, error) {
+	data, err := os.ReadFile(lock)
+	if err != nil && errors.Is(err, os.ErrNotExist) {
+		return nil, true, nil
+	}
+
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read lock: %w", err)
+	}
+
+	var createdAt time.Time
+
+	pid, nanos, host, ok := parseLockOwner(data)
+	if ok {
+		if host == lockHostID() && !processAlive(pid) {
+			return data, true, nil
+		}
+
+		createdAt = time.Unix(0, nanos)
+	} else {
+		info, err := os.Stat(lock)
+		if err != nil && errors.Is(err, os.ErrNotExist) {
+			return nil, true, nil
+		}
+
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to check lock: %w", err)
+		}
+
+		createdAt = info.ModTime()
+	}
+
+	return data, staleTTL > 0 && time.Since(createdAt) > staleTTL, nil
+}
+
+func parseLockOwner(data []byte) (pid int, nanos int64, host string, ok bool) {
+	fields := strings.Fields(string(data))
+	if len(fields) != 4 {
+		return 0, 0, "", false
+	}
+
+	pid, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, 0, "", false
+	}
+
+	nanos, err = strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, 0, "", false
+	}
+
+	return pid, nanos, fields[2], true
+}
+
+// lockHostID identifies the host and, where available, the PID namespace of
+// this process, so that PIDs are only compared between processes that share
+// them.
+var lockHostID = sync.OnceValue(func() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "unknown"
+	}
+
+	if ns, err := os.Readlink("/proc/self/ns/pid"); err == nil {
+		host = fmt.Sprintf("%s/%s", host, ns)
+	}
+
+	return strings.ReplaceAll(host, " ", "_")
+})
+
+// lockGuardPollingInterval is how often a busy guard is retried. Guards are only
+// held for a few file operations.
+const lockGuardPollingInterval = time.Millisecond
+
+// withLockGuard runs fn while holding the guard for the lock. The guard
+// serializes removing the lock file, so that a lock can only be removed by the
+// process that checked it.
+// The guard is an OS file lock on a file next to the lock, so it is released
+// by the OS if its holder crashes. The guard file is never removed, as a
+// process could be waiting on the removed file while another creates and
+// locks a new one. Waiting for the guard stops when ctx is done.
+func withLockGuard(ctx context.Context, lock string, fn func() error) error {
+	guard := fmt.Sprintf("%s.guard", lock)
+
+	f, err := os.OpenFile(guard, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open lock guard: %w", err)
+	}
+	defer f.Close()
+
+	for {
+		err := tryLockFile(f)
+		if err == nil {
+			break
+		}
+
+		if !errors.Is(err, errFileLocked) {
+			return fmt.Errorf("failed to lock guard: %w", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		case <-time.After(lockGuardPollingInterval):
+		}
+	}
+	defer unlockFile(f)
+
+	return fn()
+}
@@ -0,0 +1,214 @@
+package interstate
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+var (
+	_ KeyValueStore = (*Store)(nil)
+	_ KeyValueStore = (*MemoryStore)(nil)
+)
+
+// MemoryStore is a KeyValueStore that keeps data in memory. It is useful for
+// tests and ephemeral data. Locks and subscriptions only apply within the
+// process.
+type MemoryStore struct {
+	mu          sync.Mutex
+	data        map[string][]byte
+	locks       map[string]bool
+	subscribers map[string][]*memorySubscriber
+}
+
+type memorySubscriber struct {
+	handler SubscribeHandler
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		data:        make(map[string][]byte),
+		locks:       make(map[string]bool),
+		subscribers: make(map[string][]*memorySubscriber),
+	}
+}
+
+// Get the data for a key.
+// If the key does not exist, an empty slice and ErrKeyNotFound will
+// be returned.
+func (s *MemoryStore) Get(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, ok := s.data[key]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+
+	return slices.Clone(data), nil
+}
+
+// Put writes data for the key, obtaining the lock on the key for the duration
+// of the operation.
+func (s *MemoryStore) Put(key string, data []byte, opts ...updaterOptionsFn) error {
+	updater, err := s.Updater(key, opts...)
+	if err != nil {
+		return err
+	}
+	defer updater.Close()
+
+	return updater.Put(data)
+}
+
+// Delete the key, obtaining the lock on the key for the duration of the
+// operation.
+func (s *MemoryStore) Delete(key string, opts ...updaterOptionsFn) error {
+	updater, err := s.Updater(key, opts...)
+	if err != nil {
+		return err
+	}
+	defer updater.Close()
+
+	return updater.Delete()
+}
+
+// Updater obtains a lock on the key so that Put and Delete operations can be
+// made against the key without contention. It accepts the same options as
+// Store.Updater, except for WithStaleLockTTL which has no effect.
+func (s *MemoryStore) Updater(key string, opts ...updaterOptionsFn) (Updater, error) {
+	options := &updaterOptions{
+		pollingInterval: 100 * time.Millisecond,
+	}
+
+	for _, o := range opts {
+		o(options)
+	}
+
+	err := acquireLock(options, func(ctx context.Context) error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if s.locks[key] {
+			return ErrKeyLocked
+		}
+
+		s.locks[key] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &memoryUpdater{
+		key:   key,
+		store: s,
+	}, nil
+}
+
+func (s *MemoryStore) Subscribe(key string, handler func(UpdateOperation, []byte)) UnsubscribeFn {
+	sub := &memorySubscriber{handler: handler}
+
+	s.mu.Lock()
+	s.subscribers[key] = append(s.subscribers[key], sub)
+	s.mu.Unlock()
+
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		s.subscribers[key] = slices.DeleteFunc(s.subscribers[key], func(v *memorySubscriber) bool {
+			return v == sub
+		})
+	}
+}
+
+// notify calls the subscribers for the key. It must not be called while
+// holding s.mu, so that handlers are free to use the store.
+func (s *MemoryStore) notify(key string, op UpdateOperation, data []byte) {
+	s.mu.Lock()
+	subscribers := slices.Clone(s.subscribers[key])
+	s.mu.Unlock()
+
+	for _, sub := range subscribers {
+		sub.handler(op, data)
+	}
+}
+
+type memoryUpdater struct {
+	key      string
+	store    *MemoryStore
+	mu       sync.Mutex
+	unlocked bool
+}
+
+// Get the data for the key while holding the lock.
+// If the key does not exist, an empty slice and ErrKeyNotFound will
+// be returned.
+func (u *memoryUpdater) Get() ([]byte, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.unlocked {
+		return nil, ErrNoLock
+	}
+
+	return u.store.Get(u.key)
+}
+
+// Put the data on the key.
+func (u *memoryUpdater) Put(data []byte) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.unlocked {
+		return ErrNoLock
+	}
+
+	u.store.mu.Lock()
+	u.store.data[u.key] = slices.Clone(data)
+	u.store.mu.Unlock()
+
+	u.store.notify(u.key, UpdateOperationPut, data)
+	return nil
+}
+
+// Delete the key.
+// If the key does not exist, ErrKeyNotFound will be returned.
+func (u *memoryUpdater) Delete() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.unlocked {
+		return ErrNoLock
+	}
+
+	u.store.mu.Lock()
+	_, ok := u.store.data[u.key]
+	delete(u.store.data, u.key)
+	u.store.mu.Unlock()
+
+	if !ok {
+		return ErrKeyNotFound
+	}
+
+	u.store.notify(u.key, UpdateOperationDelete, nil)
+	return nil
+}
+
+// Close releases the lock. Calling Close more than once is a no-op.
+func (u *memoryUpdater) Close() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.unlocked {
+		return nil
+	}
+
+	u.store.mu.Lock()
+	delete(u.store.locks, u.key)
+	u.store.mu.Unlock()
+
+	u.unlocked = true
+	return nil
+}
@@ -1,12 +1,17 @@
 package interstate
 
 import (
+	"context"
 	"crypto/sha256"
 	"errors"
 	"fmt"
-	"math/rand/v2"
+	"io/fs"
 	"os"
 	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -25,11 +30,38 @@ var (
 )
 
 type SubscribeHandler func(op UpdateOperation, data []byte)
+type KeyedSubscribeHandler func(key string, op UpdateOperation, data []byte)
 type UnsubscribeFn func()
 
+// FileInfo describes the value stored for a key.
+type FileInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// KeyValueStore is implemented by Store, which persists data in the
+// filesystem, and MemoryStore, which keeps data in memory.
+type KeyValueStore interface {
+	Get(key string) ([]byte, error)
+	Put(key string, data []byte, opts ...updaterOptionsFn) error
+	Delete(key string, opts ...updaterOptionsFn) error
+	Updater(key string, opts ...updaterOptionsFn) (Updater, error)
+	Subscribe(key string, handler func(UpdateOperation, []byte)) UnsubscribeFn
+}
+
+// Updater holds the lock on a key until Close is called.
+type Updater interface {
+	Get() ([]byte, error)
+	Put(data []byte) error
+	Delete() error
+	Close() error
+}
+
 type Store struct {
-	dir      string
-	notifier Notifier
+	dir         string
+	shardLength int
+	notifier    Notifier
 }
 
 type Notifier interface {
@@ -46,6 +78,15 @@ func WithNotifier(n Notifier) storeOptionsFn {
 	}
 }
 
+// WithShardLength stores each key in a subdirectory named after the first n hex
+// characters of the key's hash, rather than in a single flat directory.
+// Subdirectories are created as keys are written.
+func WithShardLength(n int) storeOptionsFn {
+	return func(s *Store) {
+		s.shardLength = min(max(n, 0), sha256.Size*2)
+	}
+}
+
 func NewStore(dir string, opts ...storeOptionsFn) *Store {
 	store := &Store{
 		dir: dir,
@@ -67,10 +108,15 @@ func (s *Store) Open() error {
 	return nil
 }
 
-// Close removes the store directory and all the data within it.
-// It is not necessary to call Close, and should only be called if you want to
-// cleanup the data.
+// Close the store.
+// The data in the store is left intact. Use Destroy to remove it.
 func (s *Store) Close() error {
+	return nil
+}
+
+// Destroy removes the store directory and all the data within it.
+// It should only be called if you want to cleanup the data.
+func (s *Store) Destroy() error {
 	if err := os.RemoveAll(s.dir); err != nil {
 		return fmt.Errorf("failed to remove the store directory: %w", err)
 	}
@@ -82,10 +128,7 @@ func (s *Store) Close() error {
 // If the key does not exist, an empty slice and ErrKeyNotFound will
 // be returned.
 func (s *Store) Get(key string) ([]byte, error) {
-	hash := hashKey(key)
-	path := path.Join(s.dir, hash)
-
-	data, err := os.ReadFile(path)
+	data, err := os.ReadFile(s.keyPath(key))
 	if err != nil && errors.Is(err, os.ErrNotExist) {
 		return nil, ErrKeyNotFound
 	}
@@ -97,6 +140,112 @@ func (s *Store) Get(key string) ([]byte, error) {
 	return data, nil
 }
 
+// Stat returns the size and last modified time of the data for a key without
+// reading it.
+// If the key does not exist, ErrKeyNotFound will be returned.
+func (s *Store) Stat(key string) (FileInfo, error) {
+	info, err := os.Stat(s.keyPath(key))
+	if err != nil && errors.Is(err, os.ErrNotExist) {
+		return FileInfo{}, ErrKeyNotFound
+	}
+
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("failed to stat data for key %q: %w", key, err)
+	}
+
+	return FileInfo{
+		Key:     key,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}, nil
+}
+
+// GetConsistent is like Get, but will not read the data while an Updater holds
+// the lock on the key. It does not take the lock itself, so readers never
+// block each other or writers.
+// By default, if the key is locked, ErrKeyLocked will be returned. The same
+// options as Updater can be used to wait for the lock to be released. Stale
+// locks are ignored.
+// The lock is not checked for ownership, so calling GetConsistent with
+// WithWaitForLock while holding an Updater for the key will wait forever unless
+// WithWaitTimeout or WithContext is also given. Use Updater.Get to read the key
+// while holding its lock.
+func (s *Store) GetConsistent(key string, opts ...updaterOptionsFn) ([]byte, error) {
+	options := &updaterOptions{
+		pollingInterval: 100 * time.Millisecond,
+	}
+
+	for _, o := range opts {
+		o(options)
+	}
+
+	lock := fmt.Sprintf("%s.lock", s.keyPath(key))
+
+	err := acquireLock(options, func(ctx context.Context) error {
+		_, stale, err := isStaleLock(lock, options.staleLockTTL)
+		if err != nil {
+			return err
+		}
+
+		if !stale {
+			return ErrKeyLocked
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s.Get(key)
+}
+
+// Keys returns all of the keys in the store, sorted.
+// Because keys are hashed on disk, each key's name is stored alongside its
+// data. Data written by a version of Interstate that did not store key names
+// will not be listed.
+func (s *Store) Keys() ([]string, error) {
+	keys := []string{}
+
+	err := filepath.WalkDir(s.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil && errors.Is(err, os.ErrNotExist) && p == s.dir {
+			return filepath.SkipDir
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() || !strings.HasSuffix(p, keyNameExt) {
+			return nil
+		}
+
+		exists, err := fileExists(strings.TrimSuffix(p, keyNameExt))
+		if err != nil || !exists {
+			return err
+		}
+
+		name, err := os.ReadFile(p)
+		if err != nil && errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		keys = append(keys, string(name))
+		return nil
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list keys: %w", err)
+	}
+
+	slices.Sort(keys)
+	return keys, nil
+}
+
 // Put writes data for the key.
 // Will obtain a lock on the key so that no other process or goroutine can
 // write to the key at the same time. The lock will be released as soon
@@ -133,9 +282,18 @@ func (s *Store) Delete(key string, opts ...updaterOptionsFn) error {
 // By default, if a lock has already been obtained on the
 // key, Updater will return ErrKeyLocked. Use the options params to override
 // this behavior to wait for the lock to be available.
-// When waiting for the lock, Updater will default to timeout after 10s and
-// will poll the filesystem for the lock every 100ms.
-func (s *Store) Updater(key string, opts ...updaterOptionsFn) (*Updater, error) {
+// When waiting for the lock, Updater will poll the filesystem for the lock
+// every 100ms. There is no default timeout: without WithWaitTimeout or
+// WithContext, WithWaitForLock will wait forever.
+// A lock left behind by a process that is no longer running is considered
+// stale and will be reclaimed. This check is only made for locks created on the
+// same host and in the same PID namespace. Use WithStaleLockTTL to also reclaim
+// locks that have been held for too long, which is the only way to reclaim
+// locks when the directory is shared between containers or hosts.
+// Reclaiming a stale lock takes a guard on the lock, which is an OS file lock
+// held only for a few file operations and released if its holder crashes.
+// Waiting for the guard honours WithContext and WithWaitTimeout.
+func (s *Store) Updater(key string, opts ...updaterOptionsFn) (Updater, error) {
 	options := &updaterOptions{
 		pollingInterval: 100 * time.Millisecond,
 	}
@@ -144,29 +302,28 @@ func (s *Store) Updater(key string, opts ...updaterOptionsFn) (*Updater, error)
 		o(options)
 	}
 
-	hash := hashKey(key)
-	lock := path.Join(s.dir, fmt.Sprintf("%s.lock", hash))
+	keyPath := s.keyPath(key)
+	lock := fmt.Sprintf("%s.lock", keyPath)
 
-	if options.waitForLock {
-		if err := waitForLock(lock, options.pollingInterval, options.waitTimeout); err != nil {
-			return nil, err
-		}
-	} else {
-		if err := tryLock(lock); err != nil {
-			return nil, err
-		}
+	if err := os.MkdirAll(path.Dir(keyPath), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create key directory: %w", err)
 	}
 
-	f, err := os.Create(lock)
+	var owner string
+	err := acquireLock(options, func(ctx context.Context) error {
+		var err error
+		owner, err = tryLock(ctx, lock, options.staleLockTTL)
+		return err
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to create lock file: %w", err)
+		return nil, err
 	}
-	defer f.Close()
 
-	return &Updater{
+	return &fileUpdater{
 		key:      key,
-		keyPath:  path.Join(s.dir, hashKey(key)),
+		keyPath:  keyPath,
 		lock:     lock,
+		owner:    owner,
 		notifier: s.notifier,
 	}, nil
 }
@@ -179,21 +336,77 @@ func (s *Store) Subscribe(key string, handler func(UpdateOperation, []byte)) Uns
 	return s.notifier.Subscribe(key, handler)
 }
 
-type Updater struct {
+// SubscribeKeyed is like Subscribe, but the key is passed to the handler so
+// that a single handler can be shared across subscriptions to many keys.
+func (s *Store) SubscribeKeyed(key string, handler KeyedSubscribeHandler) UnsubscribeFn {
+	return s.Subscribe(key, func(op UpdateOperation, data []byte) {
+		handler(key, op, data)
+	})
+}
+
+// keyPath returns the path of the data file for a key, taking sharding into
+// account.
+func (s *Store) keyPath(key string) string {
+	hash := hashKey(key)
+	if s.shardLength == 0 {
+		return path.Join(s.dir, hash)
+	}
+
+	return path.Join(s.dir, hash[:s.shardLength], hash)
+}
+
+type fileUpdater struct {
 	key      string
 	keyPath  string
 	lock     string
+	owner    string
+	mu       sync.Mutex
 	unlocked bool
 	notifier Notifier
 }
 
+// Get the data for the key while holding the lock, so that it reflects any
+// writes made with this Updater.
+// If the key does not exist, an empty slice and ErrKeyNotFound will
+// be returned.
+func (u *fileUpdater) Get() ([]byte, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.unlocked {
+		return nil, ErrNoLock
+	}
+
+	data, err := os.ReadFile(u.keyPath)
+	if err != nil && errors.Is(err, os.ErrNotExist) {
+		return nil, ErrKeyNotFound
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read data for key %q: %w", u.key, err)
+	}
+
+	return data, nil
+}
+
 // Put the data on the key.
-func (u *Updater) Put(data []byte) error {
+// The data is written to a temporary file which then replaces the existing
+// data, so readers will never see a partially written value.
+func (u *fileUpdater) Put(data []byte) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
 	if u.unlocked {
 		return ErrNoLock
 	}
 
-	if err := os.WriteFile(u.keyPath, data, 0755); err != nil {
+	// The name is written first so that committed data is always listed by
+	// Keys. A name without data is skipped by Keys.
+	if err := writeKeyName(u.keyPath, u.key); err != nil {
+		return fmt.Errorf("failed to write name for key %q: %w", u.key, err)
+	}
+
+	if err := writeFileAtomic(u.keyPath, data, 0644); err != nil {
 		return fmt.Errorf("failed to write data for key %q: %w", u.key, err)
 	}
 
@@ -205,15 +418,28 @@ func (u *Updater) Put(data []byte) error {
 }
 
 // Delete the key.
-func (u *Updater) Delete() error {
+// If the key does not exist, ErrKeyNotFound will be returned.
+func (u *fileUpdater) Delete() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
 	if u.unlocked {
 		return ErrNoLock
 	}
 
-	if err := os.Remove(u.keyPath); err != nil {
+	err := os.Remove(u.keyPath)
+	if err != nil && errors.Is(err, os.ErrNotExist) {
+		return ErrKeyNotFound
+	}
+
+	if err != nil {
 		return fmt.Errorf("failed to delete data for key %q: %w", u.key, err)
 	}
 
+	if err := os.Remove(keyNamePath(u.keyPath)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete name for key %q: %w", u.key, err)
+	}
+
 	if u.notifier != nil {
 		u.notifier.Delete(u.key)
 	}
@@ -223,73 +449,43 @@ func (u *Updater) Delete() error {
 
 // Close releases the lock.
 // After calling Close, any calls to Put and Delete will fail with an ErrNoLock
-// error.
-func (u *Updater) Close() error {
-	if err := os.Remove(u.lock); err != nil {
-		return fmt.Errorf("failed to remove lock: %w", err)
-	}
-
-	u.unlocked = true
-	return nil
-}
-
-func hashKey(key string) string {
-	s := sha256.New()
-	s.Write([]byte(key))
-	hash := s.Sum(nil)
-	return fmt.Sprintf("%x", hash)
-}
-
-func tryLock(lock string) error {
-	delay := time.Duration(rand.IntN(500)) * time.Millisecond
-	time.Sleep(delay)
+// error. Calling Close more than once is a no-op.
+// Close takes the guard on the lock, so it waits for any other process that is
+// reclaiming the lock at the same time. The guard is only held for a few file
+// operations, and a leftover guard file does not block.
+func (u *fileUpdater) Close() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
 
-	exists, err := fileExists(lock)
-	if err != nil {
-		return fmt.Errorf("failed to check lock: %w", err)
+	if u.unlocked {
+		return nil
 	}
 
-	if exists {
-		return ErrKeyLocked
+	if err := releaseLock(u.lock, u.owner); err != nil {
+		return err
 	}
 
+	u.unlocked = true
 	return nil
 }
 
-func waitForLock(lock string, poll time.Duration, timeout *time.Duration) error {
-	readyChan := make(chan struct{})
-	errChan := make(chan error)
-
-	timeoutChan := make(<-chan time.Time)
-	if timeout != nil {
-		timeoutChan = time.After(*timeout)
-	}
+const keyNameExt = ".key"
 
-	go func() {
-		for {
-			err := tryLock(lock)
-			if err == nil {
-				close(readyChan)
-			}
+func keyNamePath(keyPath string) string {
+	return keyPath + keyNameExt
+}
 
-			if !errors.Is(err, ErrKeyLocked) {
-				errChan <- err
-			}
+// writeKeyName stores the name of the key next to its data, so that it can be
+// listed by Keys. The name never changes, so it is only written once.
+func writeKeyName(keyPath string, key string) error {
+	name := keyNamePath(keyPath)
 
-			time.Sleep(poll)
-		}
-	}()
-
-	for {
-		select {
-		case <-timeoutChan:
-			return ErrLockTimeout
-		case <-readyChan:
-			return nil
-		case err := <-errChan:
-			return err
-		}
+	exists, err := fileExists(name)
+	if err != nil || exists {
+		return err
 	}
+
+	return writeFileAtomic(name, []byte(key), 0644)
 }
 
 func fileExists(path string) (bool, error) {
@@ -308,3 +504,41 @@ func fileExists(path string) (bool, error) {
 
 	return true, nil
 }
+
+func hashKey(key string) string {
+	s := sha256.New()
+	s.Write([]byte(key))
+	hash := s.Sum(nil)
+	return fmt.Sprintf("%x", hash)
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory as
+// name, then renames it over name.
+func writeFileAtomic(name string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(path.Dir(name), fmt.Sprintf("%s.*.tmp", path.Base(name)))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), name)
+}
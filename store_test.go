@@ -1,9 +1,20 @@
 package interstate_test
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
 	"os"
 	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/dstreet/interstate"
 	"github.com/stretchr/testify/assert"
@@ -13,108 +24,832 @@ import (
 func TestStoreOpenAndClose(t *testing.T) {
 	dir := path.Join(os.TempDir(), "interstate_test")
 	store := interstate.NewStore(dir)
+	defer store.Destroy()
 
 	err := store.Open()
 	require.NoError(t, err)
 
 	assert.DirExists(t, dir)
 
+	err = store.Put("test.data", []byte("testing"))
+	require.NoError(t, err)
+
 	err = store.Close()
 	assert.NoError(t, err)
 
+	data, err := store.Get("test.data")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("testing"), data)
+}
+
+func TestStoreDestroy(t *testing.T) {
+	dir, err := os.MkdirTemp("", "interstate_*")
+	require.NoError(t, err)
+
+	store := interstate.NewStore(dir)
+
+	err = store.Put("test.data", []byte("testing"))
+	require.NoError(t, err)
+
+	err = store.Destroy()
+	assert.NoError(t, err)
+
 	assert.NoDirExists(t, dir)
 }
 
 func TestStoreGet(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store interstate.KeyValueStore) {
+		putData := []byte("testing")
+		err := store.Put("test.data", putData)
+		assert.NoError(t, err)
+
+		getData, err := store.Get("test.data")
+		assert.NoError(t, err)
+		assert.Equal(t, putData, getData)
+	})
+}
+
+func TestStoreDelete(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store interstate.KeyValueStore) {
+		putData := []byte("testing")
+		err := store.Put("test.data", putData)
+		assert.NoError(t, err)
+
+		err = store.Delete("test.data")
+		assert.NoError(t, err)
+
+		getData, err := store.Get("test.data")
+		assert.Empty(t, getData)
+		assert.ErrorIs(t, err, interstate.ErrKeyNotFound)
+
+		err = store.Delete("test.missing")
+		assert.ErrorIs(t, err, interstate.ErrKeyNotFound)
+	})
+}
+
+func TestStorePutFile(t *testing.T) {
 	dir, err := os.MkdirTemp("", "interstate_*")
 	require.NoError(t, err)
 
 	store := interstate.NewStore(dir)
-	defer store.Close()
+	defer store.Destroy()
 
-	putData := []byte("testing")
+	putData := bytes.Repeat([]byte("testing"), 1024)
 	err = store.Put("test.data", putData)
+	require.NoError(t, err)
+
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte("test.data")))
+	keyPath := path.Join(dir, hash)
+
+	data, err := os.ReadFile(keyPath)
 	assert.NoError(t, err)
+	assert.Equal(t, putData, data)
 
-	getData, err := store.Get("test.data")
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(keyPath)
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0644), info.Mode().Perm())
+	}
+
+	tmp, err := filepath.Glob(path.Join(dir, "*.tmp"))
 	assert.NoError(t, err)
-	assert.Equal(t, putData, getData)
+	assert.Empty(t, tmp)
 }
 
-func TestStoreDelete(t *testing.T) {
+func TestStoreGetDuringPut(t *testing.T) {
+	dir, err := os.MkdirTemp("", "interstate_*")
+	require.NoError(t, err)
+
+	store := interstate.NewStore(dir)
+	defer store.Destroy()
+
+	err = store.Put("test.data", bytes.Repeat([]byte("a"), 1024))
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		for i := 0; i < 200; i++ {
+			b := byte('a' + i%26)
+			err := store.Put("test.data", bytes.Repeat([]byte{b}, 1024*(i%8+1)), interstate.WithWaitForLock())
+			assert.NoError(t, err)
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		data, err := store.Get("test.data")
+		require.NoError(t, err)
+		require.NotEmpty(t, data)
+		assert.Equal(t, 0, len(data)%1024)
+		assert.Equal(t, bytes.Repeat(data[:1], len(data)), data)
+	}
+}
+
+func TestStoreGetConsistent(t *testing.T) {
+	dir, err := os.MkdirTemp("", "interstate_*")
+	require.NoError(t, err)
+
+	store := interstate.NewStore(dir)
+	defer store.Destroy()
+
+	err = store.Put("test.data", []byte("first"))
+	require.NoError(t, err)
+
+	u, err := store.Updater("test.data")
+	require.NoError(t, err)
+
+	_, err = store.GetConsistent("test.data")
+	assert.ErrorIs(t, err, interstate.ErrKeyLocked)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		assert.NoError(t, u.Put([]byte("second")))
+		assert.NoError(t, u.Close())
+	}()
+
+	data, err := store.GetConsistent(
+		"test.data",
+		interstate.WithWaitForLock(),
+		interstate.WithPollingInterval(10*time.Millisecond),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("second"), data)
+}
+
+func TestStoreGetConsistentHoldingLock(t *testing.T) {
+	dir, err := os.MkdirTemp("", "interstate_*")
+	require.NoError(t, err)
+
+	store := interstate.NewStore(dir)
+	defer store.Destroy()
+
+	u, err := store.Updater("test.data")
+	require.NoError(t, err)
+	defer u.Close()
+
+	// Waiting on a lock held by the caller only returns because of the timeout.
+	_, err = store.GetConsistent(
+		"test.data",
+		interstate.WithWaitForLock(),
+		interstate.WithPollingInterval(10*time.Millisecond),
+		interstate.WithWaitTimeout(50*time.Millisecond),
+	)
+	assert.ErrorIs(t, err, interstate.ErrLockTimeout)
+}
+
+func TestStoreGetConsistentDoesNotLock(t *testing.T) {
+	dir, err := os.MkdirTemp("", "interstate_*")
+	require.NoError(t, err)
+
+	store := interstate.NewStore(dir, interstate.WithShardLength(2))
+	defer store.Destroy()
+
+	_, err = store.GetConsistent("test.data")
+	assert.ErrorIs(t, err, interstate.ErrKeyNotFound)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	err = store.Put("test.data", []byte("testing"))
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			data, err := store.GetConsistent("test.data")
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("testing"), data)
+		}()
+	}
+
+	wg.Wait()
+
+	locks, err := filepath.Glob(path.Join(dir, "*", "*.lock"))
+	require.NoError(t, err)
+	assert.Empty(t, locks)
+}
+
+func TestStoreStat(t *testing.T) {
 	dir, err := os.MkdirTemp("", "interstate_*")
 	require.NoError(t, err)
 
 	store := interstate.NewStore(dir)
-	defer store.Close()
+	defer store.Destroy()
+
+	before := time.Now().Add(-time.Second)
 
 	putData := []byte("testing")
 	err = store.Put("test.data", putData)
 	assert.NoError(t, err)
 
-	err = store.Delete("test.data")
+	info, err := store.Stat("test.data")
 	assert.NoError(t, err)
+	assert.Equal(t, "test.data", info.Key)
+	assert.Equal(t, int64(len(putData)), info.Size)
+	assert.True(t, info.ModTime.After(before))
+
+	_, err = store.Stat("test.missing")
+	assert.ErrorIs(t, err, interstate.ErrKeyNotFound)
+}
+
+func TestStoreShardLength(t *testing.T) {
+	dir, err := os.MkdirTemp("", "interstate_*")
+	require.NoError(t, err)
+
+	store := interstate.NewStore(dir, interstate.WithShardLength(2))
+	defer store.Destroy()
+
+	putData := []byte("testing")
+	err = store.Put("test.data", putData)
+	assert.NoError(t, err)
+
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte("test.data")))
+	assert.FileExists(t, path.Join(dir, hash[:2], hash))
+	assert.NoFileExists(t, path.Join(dir, hash))
 
 	getData, err := store.Get("test.data")
-	assert.Empty(t, getData)
+	assert.NoError(t, err)
+	assert.Equal(t, putData, getData)
+
+	err = store.Delete("test.data")
+	assert.NoError(t, err)
+	assert.NoFileExists(t, path.Join(dir, hash[:2], hash))
+}
+
+func TestStoreKeys(t *testing.T) {
+	dir, err := os.MkdirTemp("", "interstate_*")
+	require.NoError(t, err)
+
+	store := interstate.NewStore(dir)
+	defer store.Destroy()
+
+	keys, err := store.Keys()
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+
+	for _, key := range []string{"test.c", "test.a", "test.b"} {
+		err = store.Put(key, []byte(key))
+		require.NoError(t, err)
+	}
+
+	err = store.Delete("test.b")
+	require.NoError(t, err)
+
+	u, err := store.Updater("test.locked")
+	require.NoError(t, err)
+	defer u.Close()
+
+	keys, err = store.Keys()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"test.a", "test.c"}, keys)
+}
+
+func TestStoreKeysFailedPut(t *testing.T) {
+	dir, err := os.MkdirTemp("", "interstate_*")
+	require.NoError(t, err)
+
+	store := interstate.NewStore(dir)
+	defer store.Destroy()
+
+	// A name file that can't be written fails the Put before any data is
+	// committed.
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte("test.data")))
+	err = os.Mkdir(path.Join(dir, hash+".key"), 0755)
+	require.NoError(t, err)
+
+	err = store.Put("test.data", []byte("testing"))
+	assert.Error(t, err)
+
+	_, err = store.Get("test.data")
 	assert.ErrorIs(t, err, interstate.ErrKeyNotFound)
+
+	keys, err := store.Keys()
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+}
+
+func TestStoreKeysShardLength(t *testing.T) {
+	dir, err := os.MkdirTemp("", "interstate_*")
+	require.NoError(t, err)
+
+	store := interstate.NewStore(dir, interstate.WithShardLength(2))
+	defer store.Destroy()
+
+	for _, key := range []string{"test.a", "test.b"} {
+		err = store.Put(key, []byte(key))
+		require.NoError(t, err)
+	}
+
+	keys, err := store.Keys()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"test.a", "test.b"}, keys)
 }
 
 func TestStoreSubscribe(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store interstate.KeyValueStore) {
+		var receivedOp interstate.UpdateOperation
+		var receivedData []byte
+		unsubscribe := store.Subscribe("test.data", func(op interstate.UpdateOperation, data []byte) {
+			receivedOp = op
+			receivedData = data
+		})
+		defer unsubscribe()
+
+		putData := []byte("new data")
+		err := store.Put("test.data", putData)
+		assert.NoError(t, err)
+
+		assert.Equal(t, interstate.UpdateOperationPut, receivedOp)
+		assert.Equal(t, putData, receivedData)
+	})
+}
+
+func TestStoreSubscribeKeyed(t *testing.T) {
 	dir, err := os.MkdirTemp("", "interstate_*")
 	require.NoError(t, err)
 
 	store := interstate.NewStore(dir, interstate.WithNotifier(newMockNotifier()))
-	defer store.Close()
+	defer store.Destroy()
 
-	var receivedOp interstate.UpdateOperation
-	var receivedData []byte
-	unsubscribe := store.Subscribe("test.data", func(op interstate.UpdateOperation, data []byte) {
-		receivedOp = op
-		receivedData = data
-	})
-	defer unsubscribe()
+	received := make(map[string]interstate.UpdateOperation)
+	handler := func(key string, op interstate.UpdateOperation, data []byte) {
+		received[key] = op
+	}
 
-	putData := []byte("new data")
-	err = store.Put("test.data", putData)
+	unsubscribeFirst := store.SubscribeKeyed("test.first", handler)
+	defer unsubscribeFirst()
+
+	unsubscribeSecond := store.SubscribeKeyed("test.second", handler)
+	defer unsubscribeSecond()
+
+	err = store.Put("test.first", []byte("first"))
+	assert.NoError(t, err)
+
+	err = store.Put("test.second", []byte("second"))
+	assert.NoError(t, err)
+
+	err = store.Delete("test.second")
 	assert.NoError(t, err)
 
-	assert.Equal(t, interstate.UpdateOperationPut, receivedOp)
-	assert.Equal(t, putData, receivedData)
+	assert.Equal(t, map[string]interstate.UpdateOperation{
+		"test.first":  interstate.UpdateOperationPut,
+		"test.second": interstate.UpdateOperationDelete,
+	}, received)
+}
+
+func TestStoreFSNotifier(t *testing.T) {
+	tests := map[string]int{
+		"Flat":    0,
+		"Sharded": 2,
+	}
+
+	for name, shardLength := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "interstate_*")
+			require.NoError(t, err)
+
+			notifier, err := interstate.NewFSNotifier(dir)
+			require.NoError(t, err)
+			defer notifier.Close()
+
+			writer := interstate.NewStore(dir, interstate.WithShardLength(shardLength))
+			defer writer.Destroy()
+
+			reader := interstate.NewStore(
+				dir,
+				interstate.WithShardLength(shardLength),
+				interstate.WithNotifier(notifier),
+			)
+
+			type event struct {
+				key  string
+				op   interstate.UpdateOperation
+				data []byte
+			}
+
+			events := make(chan event, 100)
+			keys := make([]string, 20)
+			for i := range keys {
+				keys[i] = fmt.Sprintf("test.data.%d", i)
+
+				unsubscribe := reader.SubscribeKeyed(keys[i], func(key string, op interstate.UpdateOperation, data []byte) {
+					events <- event{key, op, data}
+				})
+				defer unsubscribe()
+			}
+
+			// waitFor returns the next event for key with op. A key may be
+			// notified more than once when its shard directory is created.
+			waitFor := func(key string, op interstate.UpdateOperation) event {
+				timeout := time.After(time.Second)
+				for {
+					select {
+					case e := <-events:
+						if e.key == key && e.op == op {
+							return e
+						}
+					case <-timeout:
+						t.Fatalf("timed out waiting for %s of %q", op, key)
+					}
+				}
+			}
+
+			for _, key := range keys {
+				err = writer.Put(key, []byte(key))
+				require.NoError(t, err)
+
+				e := waitFor(key, interstate.UpdateOperationPut)
+				assert.Equal(t, []byte(key), e.data)
+			}
+
+			err = writer.Delete(keys[0])
+			require.NoError(t, err)
+
+			e := waitFor(keys[0], interstate.UpdateOperationDelete)
+			assert.Nil(t, e.data)
+
+			select {
+			case err := <-notifier.Errors():
+				t.Fatalf("unexpected notifier error: %v", err)
+			default:
+			}
+		})
+	}
+}
+
+func TestFSNotifierCloseConcurrent(t *testing.T) {
+	dir, err := os.MkdirTemp("", "interstate_*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	notifier, err := interstate.NewFSNotifier(dir)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, notifier.Close())
+		}()
+	}
+
+	wg.Wait()
+
+	assert.NoError(t, notifier.Close())
 }
 
 func TestUpdaterLock(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store interstate.KeyValueStore) {
+		first, err := store.Updater("test.data")
+		assert.NoError(t, err)
+		defer first.Close()
+
+		second, err := store.Updater("test.data")
+		assert.Nil(t, second)
+		assert.ErrorIs(t, err, interstate.ErrKeyLocked)
+	})
+}
+
+func TestUpdaterLockConcurrent(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store interstate.KeyValueStore) {
+		var held, maxHeld, acquired atomic.Int32
+		var wg sync.WaitGroup
+
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				u, err := store.Updater(
+					"test.data",
+					interstate.WithWaitForLock(),
+					interstate.WithPollingInterval(time.Millisecond),
+				)
+				if !assert.NoError(t, err) {
+					return
+				}
+
+				n := held.Add(1)
+				for {
+					m := maxHeld.Load()
+					if n <= m || maxHeld.CompareAndSwap(m, n) {
+						break
+					}
+				}
+
+				time.Sleep(time.Millisecond)
+				held.Add(-1)
+				acquired.Add(1)
+
+				assert.NoError(t, u.Close())
+			}()
+		}
+
+		wg.Wait()
+
+		assert.Equal(t, int32(20), acquired.Load())
+		assert.Equal(t, int32(1), maxHeld.Load())
+	})
+}
+
+func TestUpdaterWaitContext(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store interstate.KeyValueStore) {
+		first, err := store.Updater("test.data")
+		require.NoError(t, err)
+		defer first.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+
+		start := time.Now()
+		second, err := store.Updater(
+			"test.data",
+			interstate.WithWaitForLock(),
+			interstate.WithContext(ctx),
+		)
+		assert.Nil(t, second)
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Less(t, time.Since(start), time.Second)
+	})
+}
+
+func TestUpdaterCancelledContext(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store interstate.KeyValueStore) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		u, err := store.Updater("test.data", interstate.WithContext(ctx))
+		assert.Nil(t, u)
+		assert.ErrorIs(t, err, context.Canceled)
+
+		u, err = store.Updater("test.data", interstate.WithWaitForLock(), interstate.WithContext(ctx))
+		assert.Nil(t, u)
+		assert.ErrorIs(t, err, context.Canceled)
+
+		// The lock was never taken.
+		u, err = store.Updater("test.data")
+		require.NoError(t, err)
+		assert.NoError(t, u.Close())
+	})
+}
+
+func TestUpdaterStaleLock(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("process liveness is not checked on windows")
+	}
+
 	dir, err := os.MkdirTemp("", "interstate_*")
 	require.NoError(t, err)
 
 	store := interstate.NewStore(dir)
-	defer store.Close()
+	defer store.Destroy()
+
+	// The first updater is never closed, as if its process had crashed.
+	_, err = store.Updater("test.data")
+	require.NoError(t, err)
+	setLockOwner(t, dir, "test.data", 999999999, time.Now())
+
+	u, err := store.Updater("test.data")
+	require.NoError(t, err)
+	defer u.Close()
+
+	err = u.Put([]byte("testing"))
+	assert.NoError(t, err)
+}
+
+func TestUpdaterStaleLockTTL(t *testing.T) {
+	dir, err := os.MkdirTemp("", "interstate_*")
+	require.NoError(t, err)
+
+	store := interstate.NewStore(dir)
+	defer store.Destroy()
 
 	first, err := store.Updater("test.data")
+	require.NoError(t, err)
+	setLockOwner(t, dir, "test.data", os.Getpid(), time.Now().Add(-time.Minute))
+
+	u, err := store.Updater("test.data")
+	assert.Nil(t, u)
+	assert.ErrorIs(t, err, interstate.ErrKeyLocked)
+
+	second, err := store.Updater("test.data", interstate.WithStaleLockTTL(30*time.Second))
+	require.NoError(t, err)
+	defer second.Close()
+
+	// Closing the reclaimed updater must not release the new owner's lock.
+	err = first.Close()
 	assert.NoError(t, err)
-	defer first.Close()
 
-	second, err := store.Updater("test.data")
-	assert.Nil(t, second)
+	u, err = store.Updater("test.data")
+	assert.Nil(t, u)
 	assert.ErrorIs(t, err, interstate.ErrKeyLocked)
 }
 
-func TestUpdaterClose(t *testing.T) {
+func TestUpdaterStaleLockConcurrent(t *testing.T) {
 	dir, err := os.MkdirTemp("", "interstate_*")
 	require.NoError(t, err)
 
 	store := interstate.NewStore(dir)
-	defer store.Close()
+	defer store.Destroy()
 
-	u, err := store.Updater("test.data")
-	assert.NoError(t, err)
-	u.Close()
+	_, err = store.Updater("test.data")
+	require.NoError(t, err)
+	setLockOwner(t, dir, "test.data", os.Getpid(), time.Now().Add(-time.Minute))
 
-	err = u.Put([]byte("testing"))
-	assert.ErrorIs(t, err, interstate.ErrNoLock)
+	var acquired atomic.Int32
+	var wg sync.WaitGroup
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			_, err := store.Updater("test.data", interstate.WithStaleLockTTL(30*time.Second))
+			if err == nil {
+				acquired.Add(1)
+				return
+			}
+
+			assert.ErrorIs(t, err, interstate.ErrKeyLocked)
+		}()
+	}
+
+	wg.Wait()
+
+	assert.Equal(t, int32(1), acquired.Load())
+}
+
+func TestUpdaterStaleLockGuard(t *testing.T) {
+	dir, err := os.MkdirTemp("", "interstate_*")
+	require.NoError(t, err)
+
+	store := interstate.NewStore(dir)
+	defer store.Destroy()
+
+	_, err = store.Updater("test.data")
+	require.NoError(t, err)
+	setLockOwner(t, dir, "test.data", os.Getpid(), time.Now().Add(-time.Minute))
+
+	// A guard file left behind by a crashed process.
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte("test.data")))
+	guard := path.Join(dir, hash+".lock.guard")
+	err = os.WriteFile(guard, []byte("stale"), 0644)
+	require.NoError(t, err)
+	old := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(guard, old, old))
+
+	var acquired atomic.Int32
+	var wg sync.WaitGroup
+	updaters := make(chan interstate.Updater, 20)
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			u, err := store.Updater("test.data", interstate.WithStaleLockTTL(30*time.Second))
+			if err == nil {
+				acquired.Add(1)
+				updaters <- u
+				return
+			}
+
+			assert.ErrorIs(t, err, interstate.ErrKeyLocked)
+		}()
+	}
+
+	wg.Wait()
+	close(updaters)
+
+	assert.Equal(t, int32(1), acquired.Load())
+
+	start := time.Now()
+	for u := range updaters {
+		assert.NoError(t, u.Close())
+	}
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestUpdaterGet(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store interstate.KeyValueStore) {
+		u, err := store.Updater("test.data")
+		require.NoError(t, err)
+
+		_, err = u.Get()
+		assert.ErrorIs(t, err, interstate.ErrKeyNotFound)
+
+		err = u.Put([]byte("testing"))
+		require.NoError(t, err)
 
-	err = u.Delete()
-	assert.ErrorIs(t, err, interstate.ErrNoLock)
+		data, err := u.Get()
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("testing"), data)
+
+		require.NoError(t, u.Close())
+
+		_, err = u.Get()
+		assert.ErrorIs(t, err, interstate.ErrNoLock)
+	})
+}
+
+func TestUpdaterClose(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store interstate.KeyValueStore) {
+		u, err := store.Updater("test.data")
+		assert.NoError(t, err)
+		u.Close()
+
+		err = u.Put([]byte("testing"))
+		assert.ErrorIs(t, err, interstate.ErrNoLock)
+
+		err = u.Delete()
+		assert.ErrorIs(t, err, interstate.ErrNoLock)
+	})
+}
+
+func TestUpdaterCloseTwice(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store interstate.KeyValueStore) {
+		u, err := store.Updater("test.data")
+		require.NoError(t, err)
+
+		err = u.Close()
+		assert.NoError(t, err)
+
+		err = u.Close()
+		assert.NoError(t, err)
+	})
+}
+
+func TestUpdaterCloseConcurrent(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store interstate.KeyValueStore) {
+		u, err := store.Updater("test.data")
+		require.NoError(t, err)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				assert.NoError(t, u.Close())
+				assert.ErrorIs(t, u.Put([]byte("testing")), interstate.ErrNoLock)
+			}()
+		}
+
+		wg.Wait()
+
+		next, err := store.Updater("test.data")
+		require.NoError(t, err)
+		assert.NoError(t, next.Close())
+	})
+}
+
+// setLockOwner rewrites the PID and creation time recorded in the lock file
+// for key, keeping the rest of the owner intact.
+func setLockOwner(t *testing.T, dir string, key string, pid int, createdAt time.Time) {
+	t.Helper()
+
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(key)))
+	lock := path.Join(dir, hash+".lock")
+
+	data, err := os.ReadFile(lock)
+	require.NoError(t, err)
+
+	fields := strings.Fields(string(data))
+	require.Len(t, fields, 4)
+
+	fields[0] = strconv.Itoa(pid)
+	fields[1] = strconv.FormatInt(createdAt.UnixNano(), 10)
+
+	err = os.WriteFile(lock, []byte(strings.Join(fields, " ")+"\n"), 0644)
+	require.NoError(t, err)
+}
+
+// forEachStore runs fn against each KeyValueStore implementation.
+func forEachStore(t *testing.T, fn func(t *testing.T, store interstate.KeyValueStore)) {
+	t.Run("Store", func(t *testing.T) {
+		dir, err := os.MkdirTemp("", "interstate_*")
+		require.NoError(t, err)
+
+		store := interstate.NewStore(dir, interstate.WithNotifier(newMockNotifier()))
+		defer store.Destroy()
+
+		fn(t, store)
+	})
+
+	t.Run("MemoryStore", func(t *testing.T) {
+		fn(t, interstate.NewMemoryStore())
+	})
 }
 
 type mockNotifier struct {
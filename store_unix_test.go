@@ -0,0 +1,67 @@
+//go:build unix
+
+package interstate_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/dstreet/interstate"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdaterStaleLockGuardBusy(t *testing.T) {
+	dir, err := os.MkdirTemp("", "interstate_*")
+	require.NoError(t, err)
+
+	store := interstate.NewStore(dir)
+	defer store.Destroy()
+
+	_, err = store.Updater("test.data")
+	require.NoError(t, err)
+	setLockOwner(t, dir, "test.data", os.Getpid(), time.Now().Add(-time.Minute))
+
+	// Hold the guard, as another process reclaiming the lock would.
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte("test.data")))
+	guard, err := os.OpenFile(path.Join(dir, hash+".lock.guard"), os.O_CREATE|os.O_RDWR, 0644)
+	require.NoError(t, err)
+	defer guard.Close()
+	require.NoError(t, syscall.Flock(int(guard.Fd()), syscall.LOCK_EX))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	u, err := store.Updater(
+		"test.data",
+		interstate.WithStaleLockTTL(30*time.Second),
+		interstate.WithContext(ctx),
+	)
+	assert.Nil(t, u)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+
+	start = time.Now()
+	u, err = store.Updater(
+		"test.data",
+		interstate.WithStaleLockTTL(30*time.Second),
+		interstate.WithWaitForLock(),
+		interstate.WithWaitTimeout(50*time.Millisecond),
+	)
+	assert.Nil(t, u)
+	assert.ErrorIs(t, err, interstate.ErrLockTimeout)
+	assert.Less(t, time.Since(start), time.Second)
+
+	require.NoError(t, syscall.Flock(int(guard.Fd()), syscall.LOCK_UN))
+
+	u, err = store.Updater("test.data", interstate.WithStaleLockTTL(30*time.Second))
+	require.NoError(t, err)
+	assert.NoError(t, u.Close())
+}
@@ -1,11 +1,16 @@
 package interstate
 
-import "time"
+import (
+	"context"
+	"time"
+)
 
 type updaterOptions struct {
 	waitForLock     bool
 	waitTimeout     *time.Duration
 	pollingInterval time.Duration
+	staleLockTTL    time.Duration
+	ctx             context.Context
 }
 
 type updaterOptionsFn func(o *updaterOptions)
@@ -22,8 +27,20 @@ func WithWaitTimeout(v time.Duration) updaterOptionsFn {
 	}
 }
 
+func WithContext(ctx context.Context) updaterOptionsFn {
+	return func(o *updaterOptions) {
+		o.ctx = ctx
+	}
+}
+
 func WithPollingInterval(v time.Duration) updaterOptionsFn {
 	return func(o *updaterOptions) {
 		o.pollingInterval = v
 	}
 }
+
+func WithStaleLockTTL(v time.Duration) updaterOptionsFn {
+	return func(o *updaterOptions) {
+		o.staleLockTTL = v
+	}
+}